@@ -0,0 +1,185 @@
+// +build amd64
+
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gator
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+// Alloc reserves nCells contiguous cells in r and returns the cell offset of
+// the first reserved cell (i.e. the byte offset into r.Mem is offset*CellBytes).
+// As long as nothing has ever been freed, it's a plain O(1) bump of Meta.Ext1.
+// Once Free has run, Meta.freedCells is nonzero and Alloc first consults
+// Header.Bits for a reusable run among the cells Ext1 has already passed
+// over, falling back to bumping Ext1 (and, once too few cells remain past
+// Ext1, to a full Header.Bits scan) if none is free or large enough. A run
+// that the full scan takes from past Ext1 moves Ext1 to the run's end.
+func (r *Region) Alloc(nCells uint) (offset uint, ok bool) {
+	if nCells == 0 || nCells > CellCount {
+		return 0, false
+	}
+	meta := &r.Header.Meta
+	if meta.Flags.Dropped() {
+		return 0, false
+	}
+	bump := uint(meta.Ext1)
+	if meta.freedCells > 0 {
+		if reused, ok := r.Header.findFreeRun(nCells); ok && reused+nCells <= bump {
+			r.Header.setBitsRange(reused, nCells)
+			meta.freedCells -= uint32(nCells)
+			return reused, true
+		}
+	}
+	if bump+nCells <= CellCount {
+		r.Header.setBitsRange(bump, nCells)
+		meta.Ext1 = uint32(bump + nCells)
+		return bump, true
+	}
+	offset, ok = r.Header.findFreeRun(nCells)
+	if !ok {
+		return 0, false
+	}
+	r.Header.setBitsRange(offset, nCells)
+	// The run can reach past Ext1 into cells the bump path has not handed
+	// out yet; move Ext1 to its end so those cells are not handed out twice.
+	if end := offset + nCells; end > bump {
+		if offset < bump {
+			meta.freedCells -= uint32(bump - offset)
+		}
+		meta.Ext1 = uint32(end)
+	} else {
+		meta.freedCells -= uint32(nCells)
+	}
+	return offset, true
+}
+
+// Free releases nCells cells starting at offset, making them available to a
+// later Alloc call via the Header.Bits free-list scan. It does not move the
+// bump pointer back, so repeated Alloc/Free churn is served from Bits rather
+// than growing Ext1 forever. It also marks Meta.freedCells dirty, so Alloc
+// knows to consult Bits at all; a region that never calls Free keeps Alloc on
+// the bump-only fast path.
+func (r *Region) Free(offset, nCells uint) {
+	r.Header.clearBitsRange(offset, nCells)
+	r.Header.Meta.freedCells += uint32(nCells)
+}
+
+// AllocT reserves enough cells in r to hold a T and returns a pointer into
+// r.Mem. The zero value is not written; callers own initialization.
+func AllocT[T any](r *Region) (*T, bool) {
+	var zero T
+	nCells := (uint(unsafe.Sizeof(zero)) + CellBytes - 1) / CellBytes
+	offset, ok := r.Alloc(nCells)
+	if !ok {
+		return nil, false
+	}
+	return (*T)(unsafe.Pointer(&r.Mem[offset*CellBytes])), true
+}
+
+// setBitsRange sets (marks allocated) the n bits starting at start, word at a
+// time.
+func (h *RegionHeader) setBitsRange(start, n uint) {
+	for n > 0 {
+		word := start / 64
+		bit := start % 64
+		width := 64 - bit
+		cnt := n
+		if cnt > width {
+			cnt = width
+		}
+		mask := (uint64(1)<<cnt - 1) << bit
+		h.Bits[word] |= mask
+		start += cnt
+		n -= cnt
+	}
+}
+
+// clearBitsRange clears (marks free) the n bits starting at start, word at a
+// time.
+func (h *RegionHeader) clearBitsRange(start, n uint) {
+	for n > 0 {
+		word := start / 64
+		bit := start % 64
+		width := 64 - bit
+		cnt := n
+		if cnt > width {
+			cnt = width
+		}
+		mask := (uint64(1)<<cnt - 1) << bit
+		h.Bits[word] &^= mask
+		start += cnt
+		n -= cnt
+	}
+}
+
+// findFreeRun scans Bits for the first run of n consecutive clear (free)
+// bits, walking a word at a time and using bits.TrailingZeros64 to skip over
+// both allocated and free runs without testing every bit individually.
+func (h *RegionHeader) findFreeRun(n uint) (offset uint, ok bool) {
+	var run, start uint
+	for w, word := range h.Bits {
+		base := uint(w) * 64
+		if word == 0 {
+			if run == 0 {
+				start = base
+			}
+			run += 64
+			if run >= n {
+				return start, true
+			}
+			continue
+		}
+		if word == ^uint64(0) {
+			run = 0
+			continue
+		}
+		for bit := uint(0); bit < 64; {
+			shifted := word >> bit
+			if shifted&1 == 0 {
+				free := uint(64) - bit
+				if shifted != 0 {
+					free = uint(bits.TrailingZeros64(shifted))
+				}
+				if run == 0 {
+					start = base + bit
+				}
+				run += free
+				if run >= n {
+					return start, true
+				}
+				bit += free
+			} else {
+				run = 0
+				used := uint(bits.TrailingZeros64(^shifted))
+				if used == 0 {
+					used = 1
+				}
+				bit += used
+			}
+		}
+	}
+	return 0, false
+}
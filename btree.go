@@ -0,0 +1,289 @@
+// +build amd64
+
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gator
+
+// regionIndexDegree is the minimum degree (t) of the region index B-tree.
+// Nodes other than the root hold between regionIndexDegree-1 and
+// 2*regionIndexDegree-1 keys.
+const regionIndexDegree = 32
+
+// regionIndex is an in-memory B-tree keyed on indexedRegion.min, replacing
+// the sorted-slice index previously used by RegionTree. It gives FindRegion
+// the same "largest min <= addr" lookup, but with O(log n) inserts/drops
+// instead of the O(n) shifts a sorted slice requires.
+type regionIndex struct {
+	root  *regionIndexNode
+	count int
+}
+
+type regionIndexNode struct {
+	leaf     bool
+	keys     []indexedRegion
+	children []*regionIndexNode
+}
+
+// regionIndexSearch returns the number of keys in keys whose min is <= addr,
+// i.e. the position of the first key greater than addr (or len(keys) if none).
+func regionIndexSearch(keys []indexedRegion, addr uintptr) int {
+	l, r := 0, len(keys)
+	for l < r {
+		m := int(uint(l+r) >> 1)
+		if keys[m].min <= addr {
+			l = m + 1
+		} else {
+			r = m
+		}
+	}
+	return l
+}
+
+// regionIndexFindExact returns the index of the key with min == addr and
+// true, or the position addr would be inserted at and false.
+func regionIndexFindExact(keys []indexedRegion, addr uintptr) (int, bool) {
+	l, r := 0, len(keys)
+	for l < r {
+		m := int(uint(l+r) >> 1)
+		if keys[m].min < addr {
+			l = m + 1
+		} else {
+			r = m
+		}
+	}
+	if l < len(keys) && keys[l].min == addr {
+		return l, true
+	}
+	return l, false
+}
+
+func (idx *regionIndex) len() int { return idx.count }
+
+// find returns the region owning addr, descending the tree while tracking
+// the closest floor key seen so far. It does not allocate.
+func (idx *regionIndex) find(addr uintptr) *Region {
+	node := idx.root
+	var best indexedRegion
+	var ok bool
+	for node != nil {
+		i := regionIndexSearch(node.keys, addr)
+		if i > 0 {
+			best, ok = node.keys[i-1], true
+		}
+		if node.leaf {
+			break
+		}
+		node = node.children[i]
+	}
+	if !ok || addr > best.max {
+		return nil
+	}
+	return best.reg
+}
+
+func (idx *regionIndex) add(entry indexedRegion) {
+	if idx.root == nil {
+		idx.root = &regionIndexNode{leaf: true, keys: []indexedRegion{entry}}
+		idx.count++
+		return
+	}
+	if len(idx.root.keys) == 2*regionIndexDegree-1 {
+		oldRoot := idx.root
+		idx.root = &regionIndexNode{children: []*regionIndexNode{oldRoot}}
+		idx.root.splitChild(0)
+	}
+	idx.root.insertNonFull(entry)
+	idx.count++
+}
+
+// splitChild splits the full child at n.children[i] around its median key,
+// promoting the median into n.
+func (n *regionIndexNode) splitChild(i int) {
+	t := regionIndexDegree
+	child := n.children[i]
+	mid := child.keys[t-1]
+
+	sibling := &regionIndexNode{leaf: child.leaf}
+	sibling.keys = append(sibling.keys, child.keys[t:]...)
+	child.keys = child.keys[:t-1]
+	if !child.leaf {
+		sibling.children = append(sibling.children, child.children[t:]...)
+		child.children = child.children[:t]
+	}
+
+	n.keys = append(n.keys, indexedRegion{})
+	copy(n.keys[i+1:], n.keys[i:])
+	n.keys[i] = mid
+
+	n.children = append(n.children, nil)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = sibling
+}
+
+func (n *regionIndexNode) insertNonFull(entry indexedRegion) {
+	i := regionIndexSearch(n.keys, entry.min)
+	if n.leaf {
+		n.keys = append(n.keys, indexedRegion{})
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = entry
+		return
+	}
+	if len(n.children[i].keys) == 2*regionIndexDegree-1 {
+		n.splitChild(i)
+		if entry.min > n.keys[i].min {
+			i++
+		}
+	}
+	n.children[i].insertNonFull(entry)
+}
+
+func (idx *regionIndex) drop(min uintptr) {
+	if idx.root == nil {
+		return
+	}
+	idx.root.delete(min)
+	if len(idx.root.keys) == 0 {
+		if idx.root.leaf {
+			idx.root = nil
+		} else {
+			idx.root = idx.root.children[0]
+		}
+	}
+	idx.count--
+}
+
+func (n *regionIndexNode) delete(addr uintptr) {
+	t := regionIndexDegree
+	i, found := regionIndexFindExact(n.keys, addr)
+
+	if found {
+		if n.leaf {
+			n.keys = append(n.keys[:i], n.keys[i+1:]...)
+			return
+		}
+		switch {
+		case len(n.children[i].keys) >= t:
+			pred := n.children[i].max()
+			n.keys[i] = pred
+			n.children[i].delete(pred.min)
+		case len(n.children[i+1].keys) >= t:
+			succ := n.children[i+1].min()
+			n.keys[i] = succ
+			n.children[i+1].delete(succ.min)
+		default:
+			n.mergeChildren(i)
+			n.children[i].delete(addr)
+		}
+		return
+	}
+
+	if n.leaf {
+		return
+	}
+	child := n.children[i]
+	if len(child.keys) < t {
+		i = n.fill(i)
+		child = n.children[i]
+	}
+	child.delete(addr)
+}
+
+// max returns the largest key in the subtree rooted at n.
+func (n *regionIndexNode) max() indexedRegion {
+	for !n.leaf {
+		n = n.children[len(n.children)-1]
+	}
+	return n.keys[len(n.keys)-1]
+}
+
+// min returns the smallest key in the subtree rooted at n.
+func (n *regionIndexNode) min() indexedRegion {
+	for !n.leaf {
+		n = n.children[0]
+	}
+	return n.keys[0]
+}
+
+// fill ensures n.children[i] holds at least regionIndexDegree keys by
+// borrowing from a sibling or merging, returning the (possibly shifted)
+// index of the child that was filled.
+func (n *regionIndexNode) fill(i int) int {
+	t := regionIndexDegree
+	switch {
+	case i > 0 && len(n.children[i-1].keys) >= t:
+		n.borrowFromLeft(i)
+	case i < len(n.children)-1 && len(n.children[i+1].keys) >= t:
+		n.borrowFromRight(i)
+	case i < len(n.children)-1:
+		n.mergeChildren(i)
+	default:
+		n.mergeChildren(i - 1)
+		i--
+	}
+	return i
+}
+
+func (n *regionIndexNode) borrowFromLeft(i int) {
+	child, left := n.children[i], n.children[i-1]
+
+	child.keys = append(child.keys, indexedRegion{})
+	copy(child.keys[1:], child.keys)
+	child.keys[0] = n.keys[i-1]
+	n.keys[i-1] = left.keys[len(left.keys)-1]
+	left.keys = left.keys[:len(left.keys)-1]
+
+	if !child.leaf {
+		child.children = append(child.children, nil)
+		copy(child.children[1:], child.children)
+		child.children[0] = left.children[len(left.children)-1]
+		left.children = left.children[:len(left.children)-1]
+	}
+}
+
+func (n *regionIndexNode) borrowFromRight(i int) {
+	child, right := n.children[i], n.children[i+1]
+
+	child.keys = append(child.keys, n.keys[i])
+	n.keys[i] = right.keys[0]
+	right.keys = right.keys[1:]
+
+	if !child.leaf {
+		child.children = append(child.children, right.children[0])
+		right.children = right.children[1:]
+	}
+}
+
+// mergeChildren merges n.children[i], n.keys[i] and n.children[i+1] into a
+// single node stored at n.children[i].
+func (n *regionIndexNode) mergeChildren(i int) {
+	child, right := n.children[i], n.children[i+1]
+
+	child.keys = append(child.keys, n.keys[i])
+	child.keys = append(child.keys, right.keys...)
+	if !child.leaf {
+		child.children = append(child.children, right.children...)
+	}
+
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	n.children = append(n.children[:i+1], n.children[i+2:]...)
+}
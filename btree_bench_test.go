@@ -0,0 +1,173 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gator
+
+import (
+	"testing"
+)
+
+// sortedSliceIndex is the sorted-slice index RegionTree used before it moved
+// to regionIndex (btree.go). It is kept here only so the benchmarks below can
+// compare the two approaches at scale.
+type sortedSliceIndex struct {
+	entries []indexedRegion
+}
+
+func (s *sortedSliceIndex) add(entry indexedRegion) {
+	if len(s.entries) == 0 {
+		s.entries = append(s.entries, entry)
+		return
+	}
+	l, r := 0, len(s.entries)
+	for l < r {
+		m := int(uint(l+r) >> 1)
+		if s.entries[m].min < entry.min {
+			l = m + 1
+		} else {
+			r = m - 1
+		}
+	}
+	if l == len(s.entries) {
+		s.entries = append(s.entries, entry)
+	} else {
+		s.entries = append(s.entries, indexedRegion{})
+		copy(s.entries[l+1:], s.entries[l:])
+		s.entries[l] = entry
+	}
+}
+
+func (s *sortedSliceIndex) drop(min uintptr) {
+	l, r := 0, len(s.entries)-1
+	for l < r {
+		m := int(uint(l+r) >> 1)
+		if s.entries[m].min < min {
+			l = m + 1
+		} else {
+			r = m - 1
+		}
+	}
+	if l != len(s.entries)-1 {
+		copy(s.entries[l:], s.entries[l+1:])
+	} else {
+		s.entries[len(s.entries)-1].reg = nil
+	}
+	s.entries = s.entries[:len(s.entries)-1]
+}
+
+func (s *sortedSliceIndex) find(addr uintptr) *Region {
+	idx, l, r := s.entries, 0, len(s.entries)-1
+	for l < r {
+		m := int(uint(l+r) >> 1)
+		if idx[m].max < addr {
+			l = m + 1
+		} else {
+			r = m - 1
+		}
+	}
+	if l == len(idx) || l == 0 && idx[l].min > addr {
+		return nil
+	}
+	return idx[l].reg
+}
+
+// syntheticEntries builds n indexedRegion entries with distinct, increasing
+// addresses, without allocating n real (RegionBytes-sized) Regions.
+func syntheticEntries(n int) []indexedRegion {
+	placeholder := &Region{}
+	entries := make([]indexedRegion, n)
+	for i := range entries {
+		min := uintptr((i + 1) * RegionMemBytes)
+		entries[i] = indexedRegion{min, min + RegionMemBytes - 1, placeholder}
+	}
+	return entries
+}
+
+func benchmarkSliceAddDrop(b *testing.B, n int) {
+	entries := syntheticEntries(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var s sortedSliceIndex
+		for _, e := range entries {
+			s.add(e)
+		}
+		for _, e := range entries {
+			s.drop(e.min)
+		}
+	}
+}
+
+func benchmarkBTreeAddDrop(b *testing.B, n int) {
+	entries := syntheticEntries(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var idx regionIndex
+		for _, e := range entries {
+			idx.add(e)
+		}
+		for _, e := range entries {
+			idx.drop(e.min)
+		}
+	}
+}
+
+func BenchmarkIndexAddDropSlice1k(b *testing.B)   { benchmarkSliceAddDrop(b, 1000) }
+func BenchmarkIndexAddDropSlice10k(b *testing.B)  { benchmarkSliceAddDrop(b, 10000) }
+func BenchmarkIndexAddDropSlice100k(b *testing.B) { benchmarkSliceAddDrop(b, 100000) }
+
+func BenchmarkIndexAddDropBTree1k(b *testing.B)   { benchmarkBTreeAddDrop(b, 1000) }
+func BenchmarkIndexAddDropBTree10k(b *testing.B)  { benchmarkBTreeAddDrop(b, 10000) }
+func BenchmarkIndexAddDropBTree100k(b *testing.B) { benchmarkBTreeAddDrop(b, 100000) }
+
+func benchmarkSliceFind(b *testing.B, n int) {
+	entries := syntheticEntries(n)
+	var s sortedSliceIndex
+	for _, e := range entries {
+		s.add(e)
+	}
+	addr := entries[n/2].min
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.find(addr)
+	}
+}
+
+func benchmarkBTreeFind(b *testing.B, n int) {
+	entries := syntheticEntries(n)
+	var idx regionIndex
+	for _, e := range entries {
+		idx.add(e)
+	}
+	addr := entries[n/2].min
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.find(addr)
+	}
+}
+
+func BenchmarkIndexFindSlice1k(b *testing.B)   { benchmarkSliceFind(b, 1000) }
+func BenchmarkIndexFindSlice10k(b *testing.B)  { benchmarkSliceFind(b, 10000) }
+func BenchmarkIndexFindSlice100k(b *testing.B) { benchmarkSliceFind(b, 100000) }
+
+func BenchmarkIndexFindBTree1k(b *testing.B)   { benchmarkBTreeFind(b, 1000) }
+func BenchmarkIndexFindBTree10k(b *testing.B)  { benchmarkBTreeFind(b, 10000) }
+func BenchmarkIndexFindBTree100k(b *testing.B) { benchmarkBTreeFind(b, 100000) }
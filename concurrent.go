@@ -0,0 +1,178 @@
+// +build amd64
+
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gator
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// lockMeta spins on r's RegionMeta.lock. It is only called for regions that
+// belong to a concurrent RegionTree; single-threaded trees never touch lock
+// or generation, so they pay no atomic overhead.
+func (r *Region) lockMeta() {
+	for !r.tryLockMeta() {
+		runtime.Gosched()
+	}
+}
+
+// tryLockMeta acquires r's RegionMeta.lock without blocking, reporting
+// whether it succeeded.
+func (r *Region) tryLockMeta() bool {
+	return atomic.CompareAndSwapUint32(&r.Header.Meta.lock, 0, 1)
+}
+
+func (r *Region) unlockMeta() {
+	atomic.StoreUint32(&r.Header.Meta.lock, 0)
+}
+
+// dedupeNonNil returns the distinct, non-nil regions among rs, preserving
+// order of first appearance.
+func dedupeNonNil(rs []*Region) []*Region {
+	out := rs[:0]
+	for _, r := range rs {
+		if r == nil {
+			continue
+		}
+		dup := false
+		for _, o := range out {
+			if o == r {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// lockRegionWithNeighbors locks primary, then — if guard is non-nil — calls
+// guard(primary) while still holding that lock, unlocking and returning its
+// error immediately if it fails. This lets a caller check and/or mutate
+// primary's own guarded state (e.g. Flags.Dropped()) atomically with respect
+// to anyone else who locks primary first. It then calls neighbors(primary)
+// to read the linkage fields (Up/Left/Right/Down) whose targets also need to
+// be locked for the caller's mutation — safe to read now, since a region's
+// own linkage fields are only ever mutated while that region's own lock is
+// held (AddSubRegion and Drop both honor this) — and tries to lock every
+// returned region without blocking. If any of those locks is contended,
+// every lock acquired so far — including primary's — is released and the
+// whole attempt retries after a short backoff. Never blocking while already
+// holding a lock rules out the ABBA deadlock that locking "self, then
+// neighbor" here and "neighbor, then self" in a concurrent caller would
+// otherwise risk.
+func lockRegionWithNeighbors(primary *Region, guard func(*Region) error, neighbors func(*Region) []*Region) ([]*Region, error) {
+	for {
+		primary.lockMeta()
+		if guard != nil {
+			if err := guard(primary); err != nil {
+				primary.unlockMeta()
+				return nil, err
+			}
+		}
+		others := dedupeNonNil(neighbors(primary))
+		locked := others[:0]
+		acquiredAll := true
+		for _, n := range others {
+			if n == primary {
+				continue
+			}
+			if !n.tryLockMeta() {
+				acquiredAll = false
+				break
+			}
+			locked = append(locked, n)
+		}
+		if acquiredAll {
+			return append([]*Region{primary}, locked...), nil
+		}
+		for _, n := range locked {
+			n.unlockMeta()
+		}
+		primary.unlockMeta()
+		runtime.Gosched()
+	}
+}
+
+func unlockRegions(rs []*Region) {
+	for i := len(rs) - 1; i >= 0; i-- {
+		rs[i].unlockMeta()
+	}
+}
+
+// bumpGeneration marks r's linkage fields as having changed, for
+// regionHasAncestor's retry loop to notice. It's a no-op outside concurrent
+// trees.
+func bumpGeneration(tree *RegionTree, r *Region) {
+	if tree.concurrent {
+		atomic.AddUint32(&r.Header.Meta.generation, 1)
+	}
+}
+
+// regionHasAncestor reports whether target is an ancestor of start in the
+// region tree. On a concurrent tree, a plain walk could read a torn
+// Up/Left/Right/Down chain while another goroutine runs Drop or
+// NewSubRegion, so it instead walks optimistically and retries if any
+// visited region's generation counter changed in the meantime, rather than
+// taking a lock per visited region.
+func regionHasAncestor(start, target *Region) bool {
+	tree := start.Header.Meta.Tree
+	if tree == nil || !tree.concurrent {
+		for up := start.Up(); up != nil; up = up.Up() {
+			if up == target {
+				return true
+			}
+		}
+		return false
+	}
+	for {
+		type visited struct {
+			region     *Region
+			generation uint32
+		}
+		var path []visited
+		found := false
+		for up := start.Up(); up != nil; up = up.Up() {
+			path = append(path, visited{up, atomic.LoadUint32(&up.Header.Meta.generation)})
+			if up == target {
+				found = true
+				break
+			}
+		}
+		raced := false
+		for _, v := range path {
+			if atomic.LoadUint32(&v.region.Header.Meta.generation) != v.generation {
+				raced = true
+				break
+			}
+		}
+		if !raced {
+			return found
+		}
+		runtime.Gosched()
+	}
+}
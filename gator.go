@@ -27,17 +27,27 @@ package gator
 
 import (
 	"errors"
+	"sync"
 	"unsafe"
 )
 
 const (
-	RegionBytes       = 1024 * 256
 	RegionHeaderBytes = 1024 * 4
-	RegionMetaBytes   = 64
-	RegionMemBytes    = (256 - 4) * 1024
+	// RegionMetaBytes holds, beyond the base region bookkeeping: the
+	// per-region spinlock and generation counter used by concurrent
+	// RegionTrees, the relocation-offset list AssignPointer appends to (for
+	// WriteSnapshot), and the freed-cell counter Alloc/Free use to skip the
+	// Header.Bits scan when nothing has been freed. The Bits bitmap shrinks
+	// to make room for these so the header still fits in RegionHeaderBytes.
+	RegionMetaBytes = 96
 
 	CellBytes = 8
-	CellCount = ((256 - 4) * 1024) / 8 // 32256
+	// CellCount is however many cells fit in Bits (CellCount/64 uint64 words)
+	// once RegionMetaBytes is carved out of RegionHeaderBytes.
+	CellCount = (RegionHeaderBytes - RegionMetaBytes) * 8 // 32000
+
+	RegionMemBytes = CellCount * CellBytes
+	RegionBytes    = RegionHeaderBytes + RegionMemBytes
 )
 
 type RegionFlags uint32
@@ -56,9 +66,19 @@ func (f RegionFlags) Dropped() bool { return f == FlagDroppedRegion }
 
 type RegionTree struct {
 	Root  *Region
-	index []indexedRegion
+	index regionIndex
+	pool  *RegionPool
+
+	// concurrent is set by NewConcurrentRegionTree. Single-threaded trees
+	// (the common case) leave it false so FindRegion/indexAdd/indexDrop never
+	// pay for an uncontended mutex acquisition.
+	concurrent bool
+	mu         sync.RWMutex
 }
 
+// indexedRegion is a single entry in a RegionTree's index: the address range
+// owned by a region, and the region itself. Entries are kept internally in a
+// B-tree keyed on min (see regionIndex in btree.go).
 type indexedRegion struct {
 	min, max uintptr
 	reg      *Region
@@ -66,87 +86,88 @@ type indexedRegion struct {
 
 func NewRegionTree() *RegionTree { return &RegionTree{} }
 
+// NewConcurrentRegionTree creates a RegionTree that is safe to use from
+// multiple goroutines: NewSubRegion, Drop, FindRegion and AssignPointer all
+// take the necessary locks. Trees created with NewRegionTree skip that
+// locking entirely, so single-threaded callers pay no atomic/lock overhead.
+func NewConcurrentRegionTree() *RegionTree { return &RegionTree{concurrent: true} }
+
+// SetPool attaches a RegionPool that NewRootRegion/NewSubRegion will draw
+// recycled regions from, and that AddRootRegion/AddSubRegion will enforce
+// the live-region limit of.
+func (tree *RegionTree) SetPool(pool *RegionPool) { tree.pool = pool }
+
+func (tree *RegionTree) newPooledRegion() *Region {
+	if tree.pool != nil {
+		return tree.pool.getFreeRegion()
+	}
+	return &Region{}
+}
+
 func (tree *RegionTree) NewRootRegion() (*Region, error) {
-	root := &Region{}
+	root := tree.newPooledRegion()
 	if err := tree.AddRootRegion(root); err != nil {
+		if tree.pool != nil {
+			tree.pool.putFreeRegion(root)
+		}
 		return nil, err
 	}
 	return root, nil
 }
 
 func (tree *RegionTree) AddRootRegion(root *Region) error {
+	if tree.concurrent {
+		tree.mu.Lock()
+		defer tree.mu.Unlock()
+	}
 	if tree.Root != nil {
 		return errors.New("root region already exists")
 	}
+	if tree.pool != nil {
+		if err := tree.pool.tryAcquire(); err != nil {
+			return err
+		}
+	}
 	root.Header = RegionHeader{Meta: RegionMeta{
 		Tree: tree,
 	}}
 	tree.Root = root
-	tree.indexAdd(root)
+	tree.indexAddLocked(root)
 	return nil
 }
 
 func (tree *RegionTree) FindRegion(mem *byte) *Region {
-	idx, addr := tree.index, uintptr(unsafe.Pointer(mem))
-	l, r := 0, len(idx)-1
-	for l < r {
-		m := int(uint(l+r) >> 1)
-		if idx[m].max < addr {
-			l = m + 1
-		} else {
-			r = m - 1
-		}
+	if tree.concurrent {
+		tree.mu.RLock()
+		defer tree.mu.RUnlock()
 	}
-	if l == len(idx) || l == 0 && idx[l].min > addr {
-		return nil
-	}
-	return idx[l].reg
+	return tree.index.find(uintptr(unsafe.Pointer(mem)))
 }
 
 func (tree *RegionTree) indexAdd(region *Region) {
+	if tree.concurrent {
+		tree.mu.Lock()
+		defer tree.mu.Unlock()
+	}
+	tree.indexAddLocked(region)
+}
+
+// indexAddLocked adds region to the index without taking tree.mu; callers
+// that already hold the write lock (AddRootRegion) use this directly to
+// avoid re-locking the non-reentrant mutex.
+func (tree *RegionTree) indexAddLocked(region *Region) {
 	min := uintptr(unsafe.Pointer(&region.Mem[0]))
 	max := min + RegionMemBytes - 1
-	if len(tree.index) == 0 {
-		tree.index = append(tree.index, indexedRegion{min, max, region})
-		return
-	}
-	idx, l, r := tree.index, 0, len(tree.index)
-	for l < r {
-		m := int(uint(l+r) >> 1)
-		idxmin := idx[m].min
-		if idxmin < min {
-			l = m + 1
-		} else {
-			r = m - 1
-		}
-	}
-	if l == len(tree.index) {
-		tree.index = append(tree.index, indexedRegion{min, max, region})
-	} else {
-		tree.index = append(tree.index, indexedRegion{})
-		copy(tree.index[l+1:], tree.index[l:])
-		tree.index[l] = indexedRegion{min, max, region}
-	}
+	tree.index.add(indexedRegion{min, max, region})
 }
 
 func (tree *RegionTree) indexDrop(region *Region) {
 	min := uintptr(unsafe.Pointer(&region.Mem[0]))
-	idx, l, r := tree.index, 0, len(tree.index)-1
-	for l < r {
-		m := int(uint(l+r) >> 1)
-		idxmin := idx[m].min
-		if idxmin < min {
-			l = m + 1
-		} else {
-			r = m - 1
-		}
+	if tree.concurrent {
+		tree.mu.Lock()
+		defer tree.mu.Unlock()
 	}
-	if l != len(idx)-1 {
-		copy(tree.index[l:], tree.index[l+1:])
-	} else {
-		tree.index[len(tree.index)-1].reg = nil
-	}
-	tree.index = tree.index[:len(tree.index)-1]
+	tree.index.drop(min)
 }
 
 type RegionHeader struct {
@@ -162,7 +183,34 @@ type RegionMeta struct {
 	Flags                 RegionFlags
 	// Metadata extensions (e.g. stack pointer)
 	Ext1 uint32
-	Ext2 interface{}
+	// freedCells counts cells currently marked free by a prior Free call.
+	// Alloc only scans Header.Bits for a reusable run when this is nonzero,
+	// so a workload that never calls Free stays on the O(1) bump path.
+	freedCells uint32
+	Ext2       interface{}
+	// lock guards Up/Left/Right/Down against concurrent link/unlink, and
+	// relocations against concurrent AssignPointer calls, when Tree was
+	// created with NewConcurrentRegionTree; unused otherwise.
+	lock uint32
+	// generation is bumped whenever Up/Left/Right/Down change, so a
+	// concurrent ancestor walk (CanAssignPointer) can detect it raced with
+	// a Drop/NewSubRegion and retry instead of reading torn state.
+	generation uint32
+	// relocations holds, as a []relocation, every pointer AssignPointer (or
+	// AssignInteriorPointer) has written into Mem. WriteSnapshot uses it to
+	// find every slot that needs fixing up on restore, without having to
+	// reconstruct a Go pointer from a raw address stored in Mem.
+	relocations interface{}
+}
+
+// relocation records that offset bytes into a region's Mem holds a pointer
+// into pointsTo.Mem at pointsToOffset, so WriteSnapshot/ReadSnapshot can
+// translate it to the corresponding region in a restored tree instead of
+// re-deriving the target from the raw pointer value.
+type relocation struct {
+	offset         uint32
+	pointsTo       *Region
+	pointsToOffset uint32
 }
 
 func (h *RegionHeader) SetBit(index uint) {
@@ -181,8 +229,16 @@ type Region struct {
 func NewRegion() *Region { return &Region{} }
 
 func (r *Region) NewSubRegion() (*Region, error) {
-	sub := &Region{}
+	var sub *Region
+	if pool := r.Header.Meta.Tree.pool; pool != nil {
+		sub = pool.getFreeRegion()
+	} else {
+		sub = &Region{}
+	}
 	if err := r.AddSubRegion(sub); err != nil {
+		if pool := r.Header.Meta.Tree.pool; pool != nil {
+			pool.putFreeRegion(sub)
+		}
 		return nil, err
 	}
 	return sub, nil
@@ -190,46 +246,128 @@ func (r *Region) NewSubRegion() (*Region, error) {
 
 func (r *Region) AddSubRegion(sub *Region) error {
 	rmeta := &r.Header.Meta
-	if rmeta.Flags.Dropped() {
-		return errors.New("parent region has already been dropped")
-	}
 	tree := rmeta.Tree
+
+	// The Dropped guard has to be checked under r's own lock, not before it:
+	// otherwise a concurrent Drop(r) could unlink and (if pooled) recycle r
+	// between this check and the Down read/mutation below.
+	var down *Region
+	if tree.concurrent {
+		locked, err := lockRegionWithNeighbors(r,
+			func(r *Region) error {
+				if r.Header.Meta.Flags.Dropped() {
+					return errors.New("parent region has already been dropped")
+				}
+				return nil
+			},
+			func(r *Region) []*Region {
+				return []*Region{r.Header.Meta.Down}
+			},
+		)
+		if err != nil {
+			return err
+		}
+		defer unlockRegions(locked)
+		down = rmeta.Down
+	} else {
+		if rmeta.Flags.Dropped() {
+			return errors.New("parent region has already been dropped")
+		}
+		down = rmeta.Down
+	}
+
+	if tree.pool != nil {
+		if err := tree.pool.tryAcquire(); err != nil {
+			return err
+		}
+	}
+
 	sub.Header = RegionHeader{Meta: RegionMeta{
 		Tree:  tree,
 		Up:    r,
-		Right: rmeta.Down,
+		Right: down,
 		Flags: rmeta.Flags,
 	}}
-	if rmeta.Down != nil {
-		rmeta.Down.Header.Meta.Left = sub
+	if down != nil {
+		down.Header.Meta.Left = sub
+		bumpGeneration(tree, down)
 	}
 	rmeta.Down = sub
+	bumpGeneration(tree, r)
 	tree.indexAdd(sub)
 	return nil
 }
 
 func (r *Region) Drop() error {
 	meta := &r.Header.Meta
-	if meta.Flags.Dropped() {
-		return errors.New("region has already been dropped")
+	tree := meta.Tree
+
+	// Check-and-mark Dropped atomically under r's own lock, so a concurrent
+	// Drop/AddSubRegion on r can't race with this one: whichever of them
+	// locks r first decides the outcome for both. r is unlocked again before
+	// runDropCallbacks runs, since callbacks are arbitrary user code that
+	// may take a while or call back into this package.
+	if tree.concurrent {
+		r.lockMeta()
+		if meta.Flags.Dropped() {
+			r.unlockMeta()
+			return errors.New("region has already been dropped")
+		}
+		if meta.Down != nil {
+			r.unlockMeta()
+			return errors.New("region cannot be dropped until all sub-regions are dropped")
+		}
+		meta.Flags |= FlagDroppedRegion
+		r.unlockMeta()
+	} else {
+		if meta.Flags.Dropped() {
+			return errors.New("region has already been dropped")
+		}
+		if meta.Down != nil {
+			return errors.New("region cannot be dropped until all sub-regions are dropped")
+		}
+		meta.Flags |= FlagDroppedRegion
 	}
-	if meta.Down != nil {
-		return errors.New("region cannot be dropped until all sub-regions are dropped")
+
+	r.runDropCallbacks()
+
+	// Having already marked r Dropped above, re-locking r here can't race
+	// with another Drop/AddSubRegion attaching to or unlinking it a second
+	// time; guard is nil because that check already happened.
+	var locked []*Region
+	if tree.concurrent {
+		locked, _ = lockRegionWithNeighbors(r, nil, func(r *Region) []*Region {
+			m := &r.Header.Meta
+			return []*Region{m.Up, m.Left, m.Right}
+		})
 	}
-	meta.Flags |= FlagDroppedRegion
-	tree, up, left, right := meta.Tree, meta.Up, meta.Left, meta.Right
+
+	up, left, right := meta.Up, meta.Left, meta.Right
 	if r != tree.Root {
 		up.Header.Meta.Down = right
+		bumpGeneration(tree, up)
 		if left != nil {
 			left.Header.Meta.Right = right
+			bumpGeneration(tree, left)
 		}
 		if right != nil {
 			right.Header.Meta.Left = left
+			bumpGeneration(tree, right)
 		}
 	} else {
 		tree.Root = nil
 	}
 	tree.indexDrop(r)
+
+	// Unlock before releasing r to the pool: release() zeroes r and puts it
+	// back on the free list immediately, so a deferred unlock running after
+	// release would clobber whatever the next tenant writes to r.Header.Meta.lock.
+	if tree.concurrent {
+		unlockRegions(locked)
+	}
+	if tree.pool != nil {
+		tree.pool.release(r)
+	}
 	return nil
 }
 
@@ -252,9 +390,22 @@ func AssignPointer(pointerRegion *Region, pointerMemOffset uint, pointsToRegion
 		return false
 	}
 	UnsafeAssignPointer(&pointerRegion.Mem[pointerMemOffset], &pointsToRegion.Mem[pointsToMemOffset])
+	pointerRegion.recordRelocation(pointerMemOffset, pointsToRegion, pointsToMemOffset)
 	return true
 }
 
+// recordRelocation appends a relocation entry to the list WriteSnapshot
+// consults to relocate pointers written by AssignPointer/AssignInteriorPointer.
+func (r *Region) recordRelocation(offset uint, pointsTo *Region, pointsToOffset uint) {
+	meta := &r.Header.Meta
+	if meta.Tree != nil && meta.Tree.concurrent {
+		r.lockMeta()
+		defer r.unlockMeta()
+	}
+	relocs, _ := meta.relocations.([]relocation)
+	meta.relocations = append(relocs, relocation{uint32(offset), pointsTo, uint32(pointsToOffset)})
+}
+
 func UnsafeAssignPointer(mem, pointsTo *byte) {
 	*((**byte)(unsafe.Pointer(mem))) = pointsTo
 }
@@ -270,10 +421,5 @@ func CanAssignPointer(pointerRegion, pointsToRegion *Region) (ok bool) {
 	if memFlags.Static() || pointerRegion == pointsToRegion {
 		return true
 	}
-	for up := pointerRegion.Up(); up != nil; up = up.Up() {
-		if up == pointsToRegion {
-			return true
-		}
-	}
-	return false
+	return regionHasAncestor(pointerRegion, pointsToRegion)
 }
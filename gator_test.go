@@ -23,6 +23,8 @@
 package gator
 
 import (
+	"bytes"
+	"sync"
 	"testing"
 	"unsafe"
 )
@@ -70,7 +72,7 @@ func TestGator(t *testing.T) {
 	if err = root.Drop(); err != nil {
 		t.Fatal(err)
 	}
-	if tree.Root != nil || len(tree.index) != 0 {
+	if tree.Root != nil || tree.index.len() != 0 {
 		t.Fatal("regions were not dropped")
 	}
 
@@ -85,6 +87,306 @@ func TestGator(t *testing.T) {
 	}
 }
 
+func TestRegionAlloc(t *testing.T) {
+	tree := NewRegionTree()
+	root, err := tree.NewRootRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, ok := root.Alloc(4)
+	if !ok || a != 0 {
+		t.Fatalf("unexpected first allocation: offset=%v ok=%v", a, ok)
+	}
+	b, ok := root.Alloc(4)
+	if !ok || b != 4 {
+		t.Fatalf("unexpected second allocation: offset=%v ok=%v", b, ok)
+	}
+
+	root.Free(a, 4)
+	c, ok := root.Alloc(4)
+	if !ok || c != a {
+		t.Fatalf("freed cells were not reused: offset=%v ok=%v", c, ok)
+	}
+
+	if _, ok := root.Alloc(CellCount + 1); ok {
+		t.Fatalf("allocated more cells than a region holds")
+	}
+
+	type point struct{ x, y int64 }
+	p, ok := AllocT[point](root)
+	if !ok {
+		t.Fatal("failed to allocate typed value")
+	}
+	p.x, p.y = 1, 2
+	if p.x != 1 || p.y != 2 {
+		t.Fatalf("typed allocation did not round-trip: %+v", p)
+	}
+}
+
+func TestRegionOnDrop(t *testing.T) {
+	tree := NewRegionTree()
+	root, err := tree.NewRootRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := root.NewSubRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []int
+	sub.OnDrop(func() { order = append(order, 1) })
+	sub.OnDrop(func() { order = append(order, 2) })
+
+	if err = sub.Drop(); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 || order[0] != 2 || order[1] != 1 {
+		t.Fatalf("drop callbacks did not run in LIFO order: %v", order)
+	}
+
+	if err = root.Drop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAssignInteriorPointer(t *testing.T) {
+	tree := NewRegionTree()
+	root, err := tree.NewRootRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := root.NewSubRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x := new(int)
+	if AssignInteriorPointer(sub, 0, x) {
+		t.Fatal("assigned a pointer into memory outside any region")
+	}
+
+	rootVal := (*int)(unsafe.Pointer(&root.Mem[0]))
+	if !AssignInteriorPointer(sub, 0, rootVal) {
+		t.Fatal("failed to assign interior pointer into a longer-lived ancestor region")
+	}
+	if relocs, _ := sub.Header.Meta.relocations.([]relocation); len(relocs) != 1 || relocs[0].pointsTo != root {
+		t.Fatalf("AssignInteriorPointer did not record a relocation: %+v", relocs)
+	}
+
+	subVal := (*int)(unsafe.Pointer(&sub.Mem[0]))
+	if AssignInteriorPointer(root, 0, subVal) {
+		t.Fatal("assigned a pointer into a shorter-lived region")
+	}
+}
+
+func TestRegionPool(t *testing.T) {
+	pool := NewRegionPool()
+	pool.maxLive = 1 // force a small cap regardless of this host's memory
+	tree := NewRegionTree()
+	tree.SetPool(pool)
+
+	root, err := tree.NewRootRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = root.NewSubRegion(); err == nil {
+		t.Fatal("expected sub-region creation to fail once the pool's live cap is reached")
+	}
+
+	if err = root.Drop(); err != nil {
+		t.Fatal(err)
+	}
+
+	root2, err := tree.NewRootRegion()
+	if err != nil {
+		t.Fatal("expected a recycled region to be available after drop")
+	}
+	if err = root2.Drop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentRegionTree(t *testing.T) {
+	tree := NewConcurrentRegionTree()
+	root, err := tree.NewRootRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const goroutines = 8
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sub, err := root.NewSubRegion()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if tree.FindRegion(&sub.Mem[0]) != sub {
+					t.Error("failed to find concurrently-created sub-region")
+					return
+				}
+				if err = sub.Drop(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if root.Down() != nil {
+		t.Fatal("sub-regions were not all dropped")
+	}
+	if err = root.Drop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentPooledRegionTree(t *testing.T) {
+	pool := NewRegionPool()
+	pool.maxLive = 0 // unbounded, but force every region through the pool
+	tree := NewConcurrentRegionTree()
+	tree.SetPool(pool)
+
+	root, err := tree.NewRootRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const goroutines = 8
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sub, err := root.NewSubRegion()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err = sub.Drop(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if root.Down() != nil {
+		t.Fatal("sub-regions were not all dropped")
+	}
+	if err = root.Drop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConcurrentDropAndAddSubRegion races Drop and NewSubRegion against the
+// very same region, rather than against disjoint sub-regions the way
+// TestConcurrentRegionTree does: exactly one of the two must win, and the
+// loser must see an error rather than a torn Down/Flags read.
+func TestConcurrentDropAndAddSubRegion(t *testing.T) {
+	tree := NewConcurrentRegionTree()
+	root, err := tree.NewRootRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		child, err := root.NewSubRegion()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		var grandchild *Region
+		var addErr, dropErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			grandchild, addErr = child.NewSubRegion()
+		}()
+		go func() {
+			defer wg.Done()
+			dropErr = child.Drop()
+		}()
+		wg.Wait()
+
+		if (addErr == nil) == (dropErr == nil) {
+			t.Fatalf("expected exactly one of NewSubRegion/Drop to succeed: addErr=%v dropErr=%v", addErr, dropErr)
+		}
+		if addErr == nil {
+			if err = grandchild.Drop(); err != nil {
+				t.Fatal(err)
+			}
+			if err = child.Drop(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err = root.Drop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	tree := NewRegionTree()
+	root, err := tree.NewRootRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := root.NewSubRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*(*int64)(unsafe.Pointer(&root.Mem[0])) = 42
+	if !AssignPointer(sub, 0, root, 0) {
+		t.Fatal("failed to assign")
+	}
+
+	var buf bytes.Buffer
+	if err = tree.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newRoot := restored.Root
+	if newRoot == nil {
+		t.Fatal("restored tree has no root")
+	}
+	if *(*int64)(unsafe.Pointer(&newRoot.Mem[0])) != 42 {
+		t.Fatalf("root memory did not round-trip")
+	}
+	newSub := newRoot.Down()
+	if newSub == nil {
+		t.Fatal("restored root has no sub-region")
+	}
+	if newSub.Up() != newRoot {
+		t.Fatal("restored sub-region's parent link is wrong")
+	}
+	if ptr := *(*uintptr)(unsafe.Pointer(&newSub.Mem[0])); ptr != uintptr(unsafe.Pointer(&newRoot.Mem[0])) {
+		t.Fatalf("relocated pointer does not point at the restored root")
+	}
+	if restored.FindRegion(&newRoot.Mem[0]) != newRoot {
+		t.Fatal("restored root is not indexed")
+	}
+	if restored.FindRegion(&newSub.Mem[0]) != newSub {
+		t.Fatal("restored sub-region is not indexed")
+	}
+}
+
 func BenchmarkAssignPointerStackedRegions(b *testing.B) { // 6.34 ns/op
 	tree := NewRegionTree()
 
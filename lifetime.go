@@ -0,0 +1,84 @@
+// +build amd64
+
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gator
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// OnDrop registers fn to run when r is dropped, letting a region hold
+// non-POD Go values (files, mutexes, anything needing a destructor) inside
+// Mem without leaking them. Callbacks are stored on RegionMeta.Ext2 and run
+// in LIFO order by Drop, mirroring defer semantics.
+func (r *Region) OnDrop(fn func()) {
+	meta := &r.Header.Meta
+	callbacks, _ := meta.Ext2.([]func())
+	meta.Ext2 = append(callbacks, fn)
+}
+
+func (r *Region) runDropCallbacks() {
+	meta := &r.Header.Meta
+	callbacks, _ := meta.Ext2.([]func())
+	for i := len(callbacks) - 1; i >= 0; i-- {
+		callbacks[i]()
+	}
+	meta.Ext2 = nil
+}
+
+// AssignInteriorPointer writes a pointer to the interior of v (which must be
+// a non-nil Go pointer, not necessarily into region-managed memory) at
+// r.Mem[offset], but only if v points into a region that strictly outlives
+// r: an ancestor of r in the region tree, or a static region. This is the
+// same outlives check CanAssignPointer performs for region-to-region
+// assignments, extended to arbitrary Go pointers via FindRegion.
+func AssignInteriorPointer(r *Region, offset uint, v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return false
+	}
+	mem := (*byte)(unsafe.Pointer(rv.Pointer()))
+	pointsToRegion := r.Tree().FindRegion(mem)
+	if pointsToRegion == nil || !regionStrictlyOutlives(pointsToRegion, r) {
+		return false
+	}
+	UnsafeAssignPointer(&r.Mem[offset], mem)
+	pointsToOffset := uintptr(unsafe.Pointer(mem)) - uintptr(unsafe.Pointer(&pointsToRegion.Mem[0]))
+	r.recordRelocation(offset, pointsToRegion, uint(pointsToOffset))
+	return true
+}
+
+// regionStrictlyOutlives reports whether ancestor outlives r: either a
+// static region, or a proper ancestor of r in the region tree. Unlike
+// CanAssignPointer, a region is not considered to outlive itself.
+func regionStrictlyOutlives(ancestor, r *Region) bool {
+	if ancestor.Flags().Dropped() || r.Flags().Dropped() {
+		return false
+	}
+	if ancestor.Flags().Static() {
+		return true
+	}
+	return regionHasAncestor(r, ancestor)
+}
@@ -30,6 +30,15 @@ type RegionMeta struct {
 	Up, Left, Right, Down *Region
 	Flags                 RegionFlags
 	// Metadata extensions (e.g. stack pointer)
-	Ext1, Ext2, Ext3, Ext4, Ext5, Ext6, Ext7, Ext8 uint32
-	Ext9                                           interface{}
+	Ext1, Ext2, Ext3, Ext4 uint32
+	Ext9                   interface{}
+	// lock and generation mirror the amd64 RegionMeta fields used by
+	// concurrent RegionTrees; see concurrent.go.
+	lock, generation uint32
+	// freedCells mirrors the amd64 RegionMeta field used by Alloc/Free; see
+	// alloc.go.
+	freedCells uint32
+	// relocations mirrors the amd64 RegionMeta field used by WriteSnapshot;
+	// see snapshot.go.
+	relocations interface{}
 }
@@ -0,0 +1,140 @@
+// +build amd64
+
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gator
+
+import (
+	"errors"
+	"math"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// RegionPool recycles dropped *Region objects through a sync.Pool-backed
+// free list, and caps the number of live regions a RegionTree will hand out
+// based on the available memory: the cgroup memory limit on Linux, falling
+// back to GOMEMLIMIT or the process's runtime/debug soft memory limit. This
+// keeps region churn bounded by what the process can actually use instead of
+// total host memory, which matters once regions are handed out hundreds of
+// thousands of times in a long-running service.
+type RegionPool struct {
+	free    sync.Pool
+	maxLive int64
+	live    int64
+}
+
+// NewRegionPool creates a RegionPool sized from the environment. A maxLive
+// of 0 (returned when no limit can be determined) means unbounded.
+func NewRegionPool() *RegionPool {
+	pool := &RegionPool{maxLive: regionLimit()}
+	pool.free.New = func() interface{} { return new(Region) }
+	return pool
+}
+
+// getFreeRegion returns a recycled or freshly allocated *Region without
+// affecting the live-region accounting; callers that hand the region to
+// AddRootRegion/AddSubRegion rely on those to enforce maxLive.
+func (p *RegionPool) getFreeRegion() *Region {
+	return p.free.Get().(*Region)
+}
+
+// putFreeRegion returns an unused region (one that was fetched via
+// getFreeRegion but never actually added to a tree) to the free list.
+func (p *RegionPool) putFreeRegion(r *Region) {
+	p.free.Put(r)
+}
+
+// tryAcquire accounts for one more live region, failing once maxLive is
+// reached.
+func (p *RegionPool) tryAcquire() error {
+	if p.maxLive <= 0 {
+		return nil
+	}
+	if atomic.AddInt64(&p.live, 1) > p.maxLive {
+		atomic.AddInt64(&p.live, -1)
+		return errors.New("region pool: live region limit exceeded")
+	}
+	return nil
+}
+
+// release zeroes r and returns it to the free list, making it available to
+// a future getFreeRegion call instead of requiring a fresh allocation.
+func (p *RegionPool) release(r *Region) {
+	*r = Region{}
+	p.free.Put(r)
+	if p.maxLive > 0 {
+		atomic.AddInt64(&p.live, -1)
+	}
+}
+
+// regionLimit estimates how many RegionBytes-sized regions fit in the
+// memory available to this process, or 0 if that can't be determined.
+func regionLimit() int64 {
+	if limit, ok := readCgroupMemoryLimit(); ok && limit > 0 {
+		return int64(limit / RegionBytes)
+	}
+	if s := os.Getenv("GOMEMLIMIT"); s != "" {
+		if limit, ok := parseByteSize(s); ok && limit > 0 {
+			return int64(limit / RegionBytes)
+		}
+	}
+	if limit := debug.SetMemoryLimit(-1); limit > 0 && limit < math.MaxInt64 {
+		return limit / RegionBytes
+	}
+	return 0
+}
+
+// parseByteSize parses a GOMEMLIMIT-style byte quantity: an integer followed
+// by an optional B/KiB/MiB/GiB/TiB suffix.
+func parseByteSize(s string) (uint64, bool) {
+	s = strings.TrimSpace(s)
+	units := [...]struct {
+		suffix string
+		mul    uint64
+	}{
+		{"TiB", 1 << 40},
+		{"GiB", 1 << 30},
+		{"MiB", 1 << 20},
+		{"KiB", 1 << 10},
+		{"B", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseUint(strings.TrimSuffix(s, u.suffix), 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return n * u.mul, true
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
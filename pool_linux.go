@@ -0,0 +1,55 @@
+// +build linux,amd64
+
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gator
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cgroupV1UnlimitedMemory is the sentinel memory.limit_in_bytes reports
+// when no limit has been set (LONG_MAX rounded down to a page boundary).
+const cgroupV1UnlimitedMemory = 9223372036854771712
+
+// readCgroupMemoryLimit reads the current cgroup's memory limit, preferring
+// cgroup v2 (memory.max) and falling back to cgroup v1
+// (memory/memory.limit_in_bytes). It returns false if neither is present or
+// neither reports a finite limit.
+func readCgroupMemoryLimit() (uint64, bool) {
+	if b, err := os.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		if s := strings.TrimSpace(string(b)); s != "max" {
+			if v, err := strconv.ParseUint(s, 10, 64); err == nil {
+				return v, true
+			}
+		}
+	}
+	if b, err := os.ReadFile("/sys/fs/cgroup/memory/memory.limit_in_bytes"); err == nil {
+		if v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err == nil && v < cgroupV1UnlimitedMemory {
+			return v, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,196 @@
+// +build amd64
+
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gator
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// snapshotRegion pairs a region with the sequential id WriteSnapshot assigns
+// it while walking the tree in pre-order.
+type snapshotRegion struct {
+	region *Region
+	id     uint32
+	parent int32 // -1 for the root
+}
+
+// WriteSnapshot serializes tree to w: every region's Mem bytes, the
+// parent/child topology, and a relocation table for every pointer
+// AssignPointer has written, so ReadSnapshot can reconstruct an equivalent
+// tree with all internal pointers fixed up against the new region addresses.
+// Header.Bits, the Alloc bump pointer (Meta.Ext1) and OnDrop callbacks are
+// not written, so every restored region starts with no cells allocated and
+// no drop callbacks.
+func (tree *RegionTree) WriteSnapshot(w io.Writer) error {
+	var regions []snapshotRegion
+	ids := make(map[*Region]uint32)
+
+	var walk func(r *Region, parent int32)
+	walk = func(r *Region, parent int32) {
+		id := uint32(len(regions))
+		ids[r] = id
+		regions = append(regions, snapshotRegion{r, id, parent})
+		for child := r.Down(); child != nil; child = child.Right() {
+			walk(child, int32(id))
+		}
+	}
+	if tree.Root != nil {
+		walk(tree.Root, -1)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(regions))); err != nil {
+		return err
+	}
+	for _, sr := range regions {
+		if err := binary.Write(w, binary.LittleEndian, sr.id); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, sr.parent); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(sr.region.Flags())); err != nil {
+			return err
+		}
+		if _, err := w.Write(sr.region.Mem[:]); err != nil {
+			return err
+		}
+		if err := tree.writeRelocations(w, sr.region, ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRelocations emits the subset of region's recorded relocations whose
+// target is still a region in this tree, translating each one's *Region
+// target to the id WriteSnapshot assigned it.
+func (tree *RegionTree) writeRelocations(w io.Writer, region *Region, ids map[*Region]uint32) error {
+	relocs, _ := region.Header.Meta.relocations.([]relocation)
+	type wireRelocation struct{ offset, pointsToID, pointsToOffset uint32 }
+	wire := make([]wireRelocation, 0, len(relocs))
+	for _, rl := range relocs {
+		pointsToID, ok := ids[rl.pointsTo]
+		if !ok {
+			continue
+		}
+		wire = append(wire, wireRelocation{rl.offset, pointsToID, rl.pointsToOffset})
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(wire))); err != nil {
+		return err
+	}
+	for _, rl := range wire {
+		if err := binary.Write(w, binary.LittleEndian, rl.offset); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, rl.pointsToID); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, rl.pointsToOffset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSnapshot reconstructs a RegionTree written by WriteSnapshot: new
+// regions are allocated, Mem is copied back in, and every recorded
+// relocation is rewritten to point into the corresponding new region.
+func ReadSnapshot(r io.Reader) (*RegionTree, error) {
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	tree := NewRegionTree()
+	if count == 0 {
+		return tree, nil
+	}
+
+	regions := make([]*Region, count)
+	type pendingRelocation struct {
+		regionID, offset, pointsToID, pointsToOffset uint32
+	}
+	var pending []pendingRelocation
+
+	for i := uint32(0); i < count; i++ {
+		var id uint32
+		var parent int32
+		var flags uint32
+		if err := binary.Read(r, binary.LittleEndian, &id); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &parent); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &flags); err != nil {
+			return nil, err
+		}
+
+		region := &Region{}
+		if parent < 0 {
+			if err := tree.AddRootRegion(region); err != nil {
+				return nil, err
+			}
+		} else {
+			if err := regions[parent].AddSubRegion(region); err != nil {
+				return nil, err
+			}
+		}
+		region.Header.Meta.Flags = RegionFlags(flags)
+
+		if _, err := io.ReadFull(r, region.Mem[:]); err != nil {
+			return nil, err
+		}
+
+		var relocCount uint32
+		if err := binary.Read(r, binary.LittleEndian, &relocCount); err != nil {
+			return nil, err
+		}
+		for j := uint32(0); j < relocCount; j++ {
+			var pr pendingRelocation
+			pr.regionID = id
+			if err := binary.Read(r, binary.LittleEndian, &pr.offset); err != nil {
+				return nil, err
+			}
+			if err := binary.Read(r, binary.LittleEndian, &pr.pointsToID); err != nil {
+				return nil, err
+			}
+			if err := binary.Read(r, binary.LittleEndian, &pr.pointsToOffset); err != nil {
+				return nil, err
+			}
+			pending = append(pending, pr)
+		}
+
+		regions[id] = region
+	}
+
+	for _, pr := range pending {
+		region, pointsTo := regions[pr.regionID], regions[pr.pointsToID]
+		UnsafeAssignPointer(&region.Mem[pr.offset], &pointsTo.Mem[pr.pointsToOffset])
+		region.recordRelocation(uint(pr.offset), pointsTo, uint(pr.pointsToOffset))
+	}
+
+	return tree, nil
+}